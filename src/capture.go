@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"net"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/afpacket"
@@ -17,6 +21,10 @@ import (
 )
 
 type CaptureOptions struct {
+	// Engine selects the CaptureBackend implementation by name: "libpcap",
+	// "afpacket", "pfring", "xdp" or "offline". When empty, it's inferred
+	// from DevName/PcapFile/useAfpacket for backward compatibility.
+	Engine                       string
 	DevName                      string
 	useAfpacket                  bool
 	PcapFile                     string
@@ -32,11 +40,57 @@ type CaptureOptions struct {
 	IPDefraggerChannelSize       uint
 	IPDefraggerReturnChannelSize uint
 	Done                         chan bool
+	// AfpacketFanoutCount controls how many sibling TPacket sockets are opened
+	// on DevName and joined into the same fanout group. Values above 1 let
+	// the kernel load-balance flows across that many reader goroutines; 1
+	// (the default) keeps the original single-handle behaviour.
+	AfpacketFanoutCount uint
+	// AfpacketFanoutMode selects how the kernel spreads packets across the
+	// fanout group: "hash" (default, PACKET_FANOUT_HASH), "lb" (round robin),
+	// "cpu" (pin by the CPU that received the packet) or "qm" (by RX queue).
+	AfpacketFanoutMode string
+	// PcapWriterPath, when non-empty, archives every packet dnsmonster sees
+	// to a rotating PCAP-NG file at this path before it's handed to the
+	// encoder pool.
+	PcapWriterPath string
+	// PcapWriterRotateBytes rotates the archive once it grows past this
+	// many bytes. Zero disables size-based rotation.
+	PcapWriterRotateBytes uint64
+	// PcapWriterRotateInterval rotates the archive once it has been open
+	// this long, regardless of size. Zero disables time-based rotation.
+	PcapWriterRotateInterval time.Duration
+	// MetricsListen, when non-empty, starts an HTTP server on this address
+	// exposing Prometheus metrics at /metrics and Go runtime counters at
+	// /debug/vars, so operators can tell kernel drops from userspace
+	// backpressure.
+	MetricsListen string
+	// MetricsSampleInterval controls how often capture and channel-depth
+	// stats are sampled and published. Defaults to 5 seconds when zero.
+	MetricsSampleInterval time.Duration
+	// ShutdownDrainTimeout bounds how long Start waits, on shutdown, for the
+	// encoder pool and then the TCP assembler/defraggers to drain before
+	// giving up. Defaults to 10 seconds when zero.
+	ShutdownDrainTimeout time.Duration
 }
 
 type DNSCapturer struct {
-	options    CaptureOptions
-	processing chan gopacket.Packet
+	options      CaptureOptions
+	processing   chan gopacket.Packet
+	statsSource  *captureStatsSource
+	encoderWG    *sync.WaitGroup
+	downstreamWG *sync.WaitGroup
+	// startPcapWriter opens the pcap archive and launches the pcapWriterTee
+	// goroutine once Start knows the backend's real LinkType, and is nil
+	// when PcapWriterPath is unset. It can't run in NewDNSCapturer because
+	// no CaptureBackend exists yet at that point (see captureStatsSource for
+	// the same ordering problem), and it returns an error rather than
+	// calling log.Fatal so a bad PcapWriterPath surfaces through Start.
+	startPcapWriter func(layers.LinkType) error
+	// ctx governs Start's read loop and is derived from the ctx passed into
+	// NewDNSCapturer, so a caller driving its own shutdown sequencing (tests,
+	// an embedding process with its own signal handling) can cancel capture
+	// without going through handleSignals at all.
+	ctx context.Context
 }
 
 type DNSResult struct {
@@ -49,22 +103,22 @@ type DNSResult struct {
 	PacketLength uint16
 }
 
-func initializeLivePcap(devName, filter string) *pcap.Handle {
+func initializeLivePcap(devName, filter string) (*pcap.Handle, error) {
 	// Open device
 	handle, err := pcap.OpenLive(devName, 65536, true, pcap.BlockForever)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("opening device %s: %w", devName, err)
 	}
 
 	// Set Filter
 	log.Printf("Using Device: %s\n", devName)
 	log.Printf("Filter: %s\n", filter)
-	err = handle.SetBPFFilter(filter)
-	if err != nil {
-		log.Fatal(err)
+	if err := handle.SetBPFFilter(filter); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("setting filter %q on device %s: %w", filter, devName, err)
 	}
 
-	return handle
+	return handle, nil
 }
 
 type afpacketHandle struct {
@@ -102,6 +156,28 @@ func (h *afpacketHandle) SetBPFFilter(filter string, snaplen int) (err error) {
 	return h.TPacket.SetBPF(bpfIns)
 }
 
+// Stats returns the kernel-maintained packet counters for this socket. It
+// combines the legacy per-socket counters with the TPACKET_V3 block-level
+// ones so callers get a received/dropped view comparable to pcap.Handle.Stats.
+func (h *afpacketHandle) Stats() (CaptureStats, error) {
+	socketStats, socketStatsV3, err := h.TPacket.SocketStats()
+	if err != nil {
+		return CaptureStats{}, err
+	}
+	received := uint64(socketStats.Packets())
+	dropped := uint64(socketStats.Drops())
+	if v3Received := uint64(socketStatsV3.Packets()); v3Received > received {
+		received = v3Received
+	}
+	if v3Dropped := uint64(socketStatsV3.Drops()); v3Dropped > dropped {
+		dropped = v3Dropped
+	}
+	return CaptureStats{
+		PacketsReceived: received,
+		PacketsDropped:  dropped,
+	}, nil
+}
+
 func (h *afpacketHandle) Close() {
 	h.TPacket.Close()
 	// previous state detected only if auto mode was on
@@ -131,7 +207,7 @@ func afpacketComputeSize(targetSizeMb int, snaplen int, pageSize int) (
 
 	return frameSize, blockSize, numBlocks, nil
 }
-func initializeLiveAFpacket(devName, filter string) *afpacketHandle {
+func initializeLiveAFpacket(devName, filter string) (*afpacketHandle, error) {
 	// Open device
 	// var tPacket *afpacket.TPacket
 	var err error
@@ -142,7 +218,7 @@ func initializeLiveAFpacket(devName, filter string) *afpacketHandle {
 		65536,
 		os.Getpagesize())
 	if err != nil {
-		log.Fatalf("Error calculating afpacket size: %s", err)
+		return nil, fmt.Errorf("calculating afpacket size: %w", err)
 	}
 
 	handle.TPacket, err = afpacket.NewTPacket(
@@ -154,45 +230,153 @@ func initializeLiveAFpacket(devName, filter string) *afpacketHandle {
 		afpacket.SocketRaw,
 		afpacket.TPacketVersion3)
 	if err != nil {
-		log.Fatalf("Error opening afpacket interface: %s", err)
+		return nil, fmt.Errorf("opening afpacket interface %s: %w", devName, err)
 	}
 
-	handle.SetBPFFilter(filter, 1024)
+	if err := handle.SetBPFFilter(filter, 1024); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("setting filter %q on afpacket interface %s: %w", filter, devName, err)
+	}
+
+	return handle, nil
+}
+
+// afpacketFanoutTypeFromString maps the CaptureOptions.AfpacketFanoutMode
+// string to the afpacket.FanoutType the kernel expects. It defaults to
+// FanoutHash, which is the closest equivalent to RSS flow hashing.
+func afpacketFanoutTypeFromString(mode string) afpacket.FanoutType {
+	switch mode {
+	case "lb":
+		return afpacket.FanoutLoadBalance
+	case "cpu":
+		return afpacket.FanoutCPU
+	case "qm":
+		return afpacket.FanoutQueueMapping
+	case "hash", "":
+		return afpacket.FanoutHash
+	default:
+		log.Printf("Unknown afpacket fanout mode %q, falling back to hash", mode)
+		return afpacket.FanoutHash
+	}
+}
+
+// initializeLiveAFpacketFanout opens fanoutCount sibling TPacket sockets on
+// devName, installs the BPF filter on each one individually and, when
+// fanoutCount is above 1, joins them into the same kernel fanout group. The
+// kernel then spreads incoming packets across the group according to
+// fanoutMode, so each returned handle can be drained by its own goroutine
+// without the readers stepping on each other.
+func initializeLiveAFpacketFanout(devName, filter string, fanoutCount uint, fanoutMode string) ([]*afpacketHandle, error) {
+	if fanoutCount == 0 {
+		fanoutCount = 1
+	}
 
-	return handle
+	// The fanout group ID only needs to be unique per-process; pairing it
+	// with the low bits of the PID keeps concurrent dnsmonster instances on
+	// the same interface from joining each other's group by accident.
+	fanoutID := uint16(os.Getpid()) & 0xffff
+	fanoutType := afpacketFanoutTypeFromString(fanoutMode)
+
+	handles := make([]*afpacketHandle, 0, fanoutCount)
+	for i := uint(0); i < fanoutCount; i++ {
+		handle, err := initializeLiveAFpacket(devName, filter)
+		if err != nil {
+			for _, opened := range handles {
+				opened.Close()
+			}
+			return nil, err
+		}
+		if fanoutCount > 1 {
+			if err := handle.TPacket.SetFanout(fanoutType, fanoutID); err != nil {
+				handle.Close()
+				for _, opened := range handles {
+					opened.Close()
+				}
+				return nil, fmt.Errorf("joining afpacket fanout group: %w", err)
+			}
+		}
+		handles = append(handles, handle)
+	}
+	return handles, nil
 }
 
-func initializeOfflinePcap(fileName, filter string) *pcap.Handle {
+func initializeOfflinePcap(fileName, filter string) (*pcap.Handle, error) {
 	handle, err := pcap.OpenOffline(fileName)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("opening capture file %s: %w", fileName, err)
 	}
 
 	// Set Filter
 	log.Printf("Using File: %s\n", fileName)
 	log.Printf("Filter: %s\n", filter)
-	err = handle.SetBPFFilter(filter)
-	if err != nil {
-		log.Fatal(err)
+	if err := handle.SetBPFFilter(filter); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("setting filter %q on capture file %s: %w", filter, fileName, err)
 	}
-	return handle
+	return handle, nil
 }
 
-func handleInterrupt(done chan bool) {
+// handleSignals catches SIGINT and SIGTERM by calling cancel, and SIGHUP by
+// sending on reload. A SIGHUP that arrives while an earlier one is still
+// pending on reload is dropped, and the first SIGINT or SIGTERM ends the
+// handler, so later signals are not acted on. SIGHUP is handled separately
+// because it asks for a capture interface reopen (e.g. to pick up pcap
+// rotation), not a shutdown.
+func handleSignals(cancel context.CancelFunc, reload chan<- struct{}) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
-		for range c {
-			log.Printf("SIGINT received")
-			close(done)
+		for sig := range c {
+			if sig == syscall.SIGHUP {
+				log.Println("SIGHUP received, reopening capture interface")
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			log.Printf("%s received, shutting down\n", sig)
+			cancel()
 			return
 		}
 	}()
 }
 
-func NewDNSCapturer(options CaptureOptions) DNSCapturer {
+// waitWithTimeout waits for wg and reports true, or reports false once
+// timeout elapses first. The goroutine it spawns leaks until wg eventually
+// completes, which is acceptable here since it only fires during shutdown.
+func waitWithTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// NewDNSCapturer wires up the processing pipeline (encoder pool, TCP
+// assembler, IP defraggers, and optionally the pcap archive writer and
+// metrics exporter) and returns a DNSCapturer ready for Start. ctx governs
+// the capture loop Start runs; callers that don't need their own cancellation
+// can pass context.Background() and rely on Start's built-in signal handling
+// instead.
+func NewDNSCapturer(ctx context.Context, options CaptureOptions) (DNSCapturer, error) {
 	if options.DevName != "" && options.PcapFile != "" {
-		log.Fatal("You cant set DevName and PcapFile.")
+		return DNSCapturer{}, fmt.Errorf("cannot set both DevName and PcapFile")
+	}
+	if options.PcapWriterPath != "" && resolveEngineName(options) == "afpacket" {
+		// The afpacket engine's zero-copy fast path (see runAfpacketReader)
+		// sends matched UDP DNS packets straight to options.ResultChannel,
+		// never touching the channel pcapWriterTee archives from. Silently
+		// archiving only the TCP/fragment/non-matching fallback traffic
+		// would contradict what PcapWriterPath promises, so refuse the
+		// combination instead.
+		return DNSCapturer{}, fmt.Errorf("PcapWriterPath is not supported with the afpacket engine: its zero-copy fast path bypasses the archive for matched UDP DNS packets")
 	}
 	var tcpChannels []chan tcpPacket
 
@@ -203,13 +387,25 @@ func NewDNSCapturer(options CaptureOptions) DNSCapturer {
 	ip4DefraggerReturn := make(chan ipv4Defragged, options.IPDefraggerReturnChannelSize)
 	ip6DefraggerReturn := make(chan ipv6Defragged, options.IPDefraggerReturnChannelSize)
 
+	var downstreamWG sync.WaitGroup
 	for i := uint(0); i < options.TCPHandlerCount; i++ {
 		tcpChannels = append(tcpChannels, make(chan tcpPacket, options.TCPAssemblyChannelSize))
-		go tcpAssembler(tcpChannels[i], tcpReturnChannel, options.GcTime, options.Done)
+		downstreamWG.Add(1)
+		go func(ch chan tcpPacket) {
+			defer downstreamWG.Done()
+			tcpAssembler(ch, tcpReturnChannel, options.GcTime, options.Done)
+		}(tcpChannels[i])
 	}
 
-	go ipv4Defragger(ip4DefraggerChannel, ip4DefraggerReturn, options.GcTime, options.Done)
-	go ipv6Defragger(ip6DefraggerChannel, ip6DefraggerReturn, options.GcTime, options.Done)
+	downstreamWG.Add(2)
+	go func() {
+		defer downstreamWG.Done()
+		ipv4Defragger(ip4DefraggerChannel, ip4DefraggerReturn, options.GcTime, options.Done)
+	}()
+	go func() {
+		defer downstreamWG.Done()
+		ipv6Defragger(ip6DefraggerChannel, ip6DefraggerReturn, options.GcTime, options.Done)
+	}()
 
 	encoder := packetEncoder{
 		options.Port,
@@ -224,65 +420,147 @@ func NewDNSCapturer(options CaptureOptions) DNSCapturer {
 		options.Done,
 	}
 
+	var encoderWG sync.WaitGroup
 	for i := uint(0); i < options.PacketHandlerCount; i++ {
-		go encoder.run()
+		encoderWG.Add(1)
+		go func() {
+			defer encoderWG.Done()
+			encoder.run()
+		}()
+	}
+
+	captureInput := processingChannel
+	var startPcapWriter func(layers.LinkType) error
+	if options.PcapWriterPath != "" {
+		// Tee off the raw packets before they're decoded so the archive on
+		// disk is exactly what dnsmonster received, independent of anything
+		// the encoders do with it. The tee itself can't start yet: it has to
+		// tag the archive with the backend's real LinkType, and no backend
+		// exists until Start runs.
+		rawInput := make(chan gopacket.Packet, options.PacketChannelSize)
+		captureInput = rawInput
+		startPcapWriter = func(linkType layers.LinkType) error {
+			writer, err := newPcapRotatingWriter(options.PcapWriterPath, options.PcapWriterRotateBytes, options.PcapWriterRotateInterval, linkType)
+			if err != nil {
+				return fmt.Errorf("opening pcap writer sink %s: %w", options.PcapWriterPath, err)
+			}
+			go pcapWriterTee(rawInput, processingChannel, writer)
+			return nil
+		}
+	}
+
+	statsSource := &captureStatsSource{}
+	if options.MetricsListen != "" {
+		go startMetricsServer(options.MetricsListen)
+		go sampleCaptureMetrics(options, statsSource, captureMetricsChannels{
+			processing:       processingChannel,
+			tcpChannels:      tcpChannels,
+			ip4Defragger:     ip4DefraggerChannel,
+			ip6Defragger:     ip6DefraggerChannel,
+			ip4DefraggerBack: ip4DefraggerReturn,
+			ip6DefraggerBack: ip6DefraggerReturn,
+		})
 	}
-	return DNSCapturer{options, processingChannel}
+
+	return DNSCapturer{options, captureInput, statsSource, &encoderWG, &downstreamWG, startPcapWriter, ctx}, nil
 }
 
-func (capturer *DNSCapturer) Start() {
-	// var handle *pcap.Handle
-	var packetChan chan gopacket.Packet
+// Start resolves options.Engine to a CaptureBackend and pumps its packets
+// into the encoder pool until SIGINT, SIGTERM or end-of-file, then drains
+// the pipeline before returning. It no longer knows anything about pcap,
+// afpacket, PF_RING or XDP directly; each engine lives behind CaptureBackend
+// so adding one doesn't touch this loop. SIGHUP reopens the capture backend
+// in place instead of triggering shutdown, which is what lets dnsmonster
+// pick up e.g. a rotated pcap file without losing in-flight state.
+//
+// Start returns an error instead of calling log.Fatal so embedders can
+// decide how to react to capture or drain failures themselves.
+func (capturer *DNSCapturer) Start() error {
 	options := capturer.options
-	if options.DevName != "" && !options.useAfpacket {
-		liveHandle := initializeLivePcap(options.DevName, options.Filter)
-		defer liveHandle.Close()
-		packetSource := gopacket.NewPacketSource(liveHandle, liveHandle.LinkType())
-		packetSource.DecodeOptions.Lazy = true
-		packetSource.NoCopy = true
-		packetChan = packetSource.Packets()
-		log.Println("Waiting for packets")
-	} else if options.DevName != "" && options.useAfpacket {
-		liveAFHandle := initializeLiveAFpacket(options.DevName, options.Filter)
-		defer liveAFHandle.Close()
-		packetSource := gopacket.NewPacketSource(liveAFHandle, liveAFHandle.LinkType())
-		packetSource.DecodeOptions.Lazy = true
-		packetSource.NoCopy = true
-		packetChan = packetSource.Packets()
-		log.Println("Waiting for packets using AFpacket")
-	} else {
-		pcapHandle := initializeOfflinePcap(options.PcapFile, options.Filter)
-		defer pcapHandle.Close()
-		packetSource := gopacket.NewPacketSource(pcapHandle, pcapHandle.LinkType())
-		packetSource.DecodeOptions.Lazy = true
-		packetSource.NoCopy = true
-		packetChan = packetSource.Packets()
-		log.Println("Reading off Pcap file")
-	}
-
-	// Setup SIGINT handling
-	handleInterrupt(options.Done)
-	// var i uint64
+
+	backend, err := NewCaptureBackend(options)
+	if err != nil {
+		return fmt.Errorf("initializing capture backend: %w", err)
+	}
+
+	if capturer.startPcapWriter != nil {
+		// Only the first backend's LinkType matters: a SIGHUP reload is
+		// expected to reopen the same kind of source, and the tee goroutine
+		// itself outlives any single backend instance.
+		if err := capturer.startPcapWriter(backend.LinkType()); err != nil {
+			backend.Close()
+			return fmt.Errorf("starting pcap writer: %w", err)
+		}
+		capturer.startPcapWriter = nil
+	}
+
+	ctx, cancel := context.WithCancel(capturer.ctx)
+	defer cancel()
+	reload := make(chan struct{}, 1)
+	handleSignals(cancel, reload)
+
+	capturer.statsSource.set(backend)
+	packetChan := backend.Packets()
+	log.Printf("Waiting for packets using the %q engine\n", resolveEngineName(options))
+
+readLoop:
 	for {
 		select {
 		case packet := <-packetChan:
 			if packet == nil {
-				log.Println("PacketSource returned nil, exiting (Possible end of pcap file?). Sleeping for 10 seconds waiting for processing to finish")
-				time.Sleep(time.Second * 10)
-				close(options.Done)
-				return
+				log.Println("PacketSource returned nil, exiting (possible end of pcap file?)")
+				break readLoop
 			}
-			// i++
-			// if i%10000 == 0 {
-			// 	log.Printf("%dth packer", i)
-			// }
 			select {
 			case capturer.processing <- packet:
-			case <-options.Done:
-				return
+			case <-ctx.Done():
+				break readLoop
 			}
-		case <-options.Done:
-			return
+		case <-reload:
+			backend.Close()
+			backend, err = NewCaptureBackend(options)
+			if err != nil {
+				// The pipeline downstream of processingChannel is already
+				// running, so a failed reopen still has to drain it rather
+				// than just returning - otherwise the encoder pool, TCP
+				// assembler and defraggers block forever on channels no one
+				// will ever close.
+				if shutdownErr := capturer.shutdown(); shutdownErr != nil {
+					return fmt.Errorf("reopening capture backend after SIGHUP: %w (shutdown also failed: %s)", err, shutdownErr)
+				}
+				return fmt.Errorf("reopening capture backend after SIGHUP: %w", err)
+			}
+			capturer.statsSource.set(backend)
+			packetChan = backend.Packets()
+		case <-ctx.Done():
+			break readLoop
 		}
 	}
+
+	backend.Close()
+	return capturer.shutdown()
+}
+
+// shutdown closes the processing channel so the encoder pool runs dry, waits
+// for it (bounded by options.ShutdownDrainTimeout), then closes options.Done
+// so the TCP assembler and defraggers flush their in-flight state, and waits
+// for those too. Encoders are drained first because they're what feeds the
+// TCP/defragger channels; draining them out of order would race new work in
+// against the flush.
+func (capturer *DNSCapturer) shutdown() error {
+	drainTimeout := capturer.options.ShutdownDrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = 10 * time.Second
+	}
+
+	close(capturer.processing)
+	if !waitWithTimeout(capturer.encoderWG, drainTimeout) {
+		log.Printf("Timed out after %s waiting for encoder workers to drain\n", drainTimeout)
+	}
+
+	close(capturer.options.Done)
+	if !waitWithTimeout(capturer.downstreamWG, drainTimeout) {
+		return fmt.Errorf("timed out after %s waiting for TCP assembler/defraggers to flush", drainTimeout)
+	}
+	return nil
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// CaptureStats mirrors the per-interface counters exposed by whichever
+// capture engine is active (kernel receive/drop counts), independent of the
+// underlying library.
+type CaptureStats struct {
+	PacketsReceived  uint64
+	PacketsDropped   uint64
+	PacketsIfDropped uint64
+}
+
+// CaptureBackend abstracts the mechanics of pulling frames off the wire (or
+// a file), so Start() only ever talks to this interface and never to
+// pcap.Handle/afpacket.TPacket/etc. directly. This is what lets libpcap,
+// AF_PACKET, PF_RING and AF_XDP share one capture loop.
+type CaptureBackend interface {
+	Packets() <-chan gopacket.Packet
+	Stats() (CaptureStats, error)
+	Close()
+	LinkType() layers.LinkType
+}
+
+// captureBackendFactory builds a CaptureBackend for one named engine.
+// Backends gated behind a build tag (PF_RING, AF_XDP) register themselves
+// from their own file's init(), so an engine name is only known to exist
+// when that backend was actually compiled in.
+type captureBackendFactory func(options CaptureOptions) (CaptureBackend, error)
+
+var captureBackendRegistry = map[string]captureBackendFactory{}
+
+func registerCaptureBackend(name string, factory captureBackendFactory) {
+	captureBackendRegistry[name] = factory
+}
+
+func init() {
+	registerCaptureBackend("libpcap", newLibpcapBackend)
+	registerCaptureBackend("afpacket", newAfpacketBackend)
+	registerCaptureBackend("offline", newOfflineBackend)
+}
+
+// resolveEngineName returns options.Engine, or, when it was left blank, the
+// engine inferred from DevName/useAfpacket (falling back to "offline").
+// NewCaptureBackend uses it to pick the factory, and NewDNSCapturer and
+// Start's logging use it to tell which engine actually ends up in use.
+func resolveEngineName(options CaptureOptions) string {
+	if options.Engine != "" {
+		return options.Engine
+	}
+	switch {
+	case options.DevName != "" && options.useAfpacket:
+		return "afpacket"
+	case options.DevName != "":
+		return "libpcap"
+	default:
+		return "offline"
+	}
+}
+
+// NewCaptureBackend resolves options.Engine and builds the corresponding
+// CaptureBackend. When Engine is empty it falls back to the legacy
+// DevName/PcapFile/useAfpacket combination so existing configs keep working.
+func NewCaptureBackend(options CaptureOptions) (CaptureBackend, error) {
+	engine := resolveEngineName(options)
+
+	factory, ok := captureBackendRegistry[engine]
+	if !ok {
+		return nil, fmt.Errorf("unknown capture engine %q", engine)
+	}
+	return factory(options)
+}
+
+// libpcapBackend wraps a single live *pcap.Handle.
+type libpcapBackend struct {
+	handle     *pcap.Handle
+	packetChan chan gopacket.Packet
+}
+
+func newLibpcapBackend(options CaptureOptions) (CaptureBackend, error) {
+	handle, err := initializeLivePcap(options.DevName, options.Filter)
+	if err != nil {
+		return nil, err
+	}
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	packetSource.DecodeOptions.Lazy = true
+	packetSource.NoCopy = true
+	return &libpcapBackend{handle: handle, packetChan: packetSource.Packets()}, nil
+}
+
+func (b *libpcapBackend) Packets() <-chan gopacket.Packet { return b.packetChan }
+
+func (b *libpcapBackend) Stats() (CaptureStats, error) {
+	stats, err := b.handle.Stats()
+	if err != nil {
+		return CaptureStats{}, err
+	}
+	return CaptureStats{
+		PacketsReceived:  uint64(stats.PacketsReceived),
+		PacketsDropped:   uint64(stats.PacketsDropped),
+		PacketsIfDropped: uint64(stats.PacketsIfDropped),
+	}, nil
+}
+
+func (b *libpcapBackend) Close()                    { b.handle.Close() }
+func (b *libpcapBackend) LinkType() layers.LinkType { return b.handle.LinkType() }
+
+// offlineBackend wraps a single *pcap.Handle reading from a capture file.
+type offlineBackend struct {
+	handle     *pcap.Handle
+	packetChan chan gopacket.Packet
+}
+
+func newOfflineBackend(options CaptureOptions) (CaptureBackend, error) {
+	handle, err := initializeOfflinePcap(options.PcapFile, options.Filter)
+	if err != nil {
+		return nil, err
+	}
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	packetSource.DecodeOptions.Lazy = true
+	packetSource.NoCopy = true
+	return &offlineBackend{handle: handle, packetChan: packetSource.Packets()}, nil
+}
+
+func (b *offlineBackend) Packets() <-chan gopacket.Packet { return b.packetChan }
+
+func (b *offlineBackend) Stats() (CaptureStats, error) {
+	stats, err := b.handle.Stats()
+	if err != nil {
+		return CaptureStats{}, err
+	}
+	return CaptureStats{
+		PacketsReceived:  uint64(stats.PacketsReceived),
+		PacketsDropped:   uint64(stats.PacketsDropped),
+		PacketsIfDropped: uint64(stats.PacketsIfDropped),
+	}, nil
+}
+
+func (b *offlineBackend) Close()                    { b.handle.Close() }
+func (b *offlineBackend) LinkType() layers.LinkType { return b.handle.LinkType() }
+
+// afpacketBackend wraps one or more fanned-out afpacketHandles (see
+// initializeLiveAFpacketFanout), presenting them as a single packet channel.
+type afpacketBackend struct {
+	handles    []*afpacketHandle
+	packetChan chan gopacket.Packet
+	// stop is closed by Close, unlike the process-wide options.Done, so a
+	// reload's old readers actually stop instead of spinning on it.
+	stop chan struct{}
+}
+
+func newAfpacketBackend(options CaptureOptions) (CaptureBackend, error) {
+	handles, err := initializeLiveAFpacketFanout(options.DevName, options.Filter, options.AfpacketFanoutCount, options.AfpacketFanoutMode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every socket - whether or not it's actually part of a fanout group -
+	// gets its own runAfpacketReader goroutine feeding the same channel, so
+	// a count of 1 and a count > 1 only differ in how many of these run.
+	// Plain UDP DNS datagrams never reach this channel at all: they're
+	// routed straight to options.ResultChannel from inside the reader.
+	packetChan := make(chan gopacket.Packet, options.PacketChannelSize)
+	stop := make(chan struct{})
+	for _, h := range handles {
+		go runAfpacketReader(h, packetChan, stop, options)
+	}
+	return &afpacketBackend{handles: handles, packetChan: packetChan, stop: stop}, nil
+}
+
+func (b *afpacketBackend) Packets() <-chan gopacket.Packet { return b.packetChan }
+
+func (b *afpacketBackend) Stats() (CaptureStats, error) {
+	var total CaptureStats
+	for _, h := range b.handles {
+		stats, err := h.Stats()
+		if err != nil {
+			return CaptureStats{}, err
+		}
+		total.PacketsReceived += stats.PacketsReceived
+		total.PacketsDropped += stats.PacketsDropped
+		total.PacketsIfDropped += stats.PacketsIfDropped
+	}
+	return total, nil
+}
+
+func (b *afpacketBackend) Close() {
+	close(b.stop)
+	for _, h := range b.handles {
+		h.Close()
+	}
+}
+
+func (b *afpacketBackend) LinkType() layers.LinkType { return layers.LinkTypeEthernet }
@@ -0,0 +1,63 @@
+//go:build pfring
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pfring"
+)
+
+func init() {
+	registerCaptureBackend("pfring", newPfringBackend)
+}
+
+// pfringBackend wraps a single PF_RING ring. It's only compiled in with the
+// "pfring" build tag since it links against libpfring.
+type pfringBackend struct {
+	ring       *pfring.Ring
+	packetChan chan gopacket.Packet
+}
+
+func newPfringBackend(options CaptureOptions) (CaptureBackend, error) {
+	if options.DevName == "" {
+		return nil, fmt.Errorf("pfring engine requires DevName")
+	}
+
+	ring, err := pfring.NewRing(options.DevName, 65536, pfring.FlagPromisc)
+	if err != nil {
+		return nil, fmt.Errorf("opening pfring ring on %s: %w", options.DevName, err)
+	}
+	if err := ring.SetBPFFilter(options.Filter); err != nil {
+		ring.Close()
+		return nil, fmt.Errorf("installing BPF filter on pfring ring: %w", err)
+	}
+	if err := ring.Enable(); err != nil {
+		ring.Close()
+		return nil, fmt.Errorf("enabling pfring ring: %w", err)
+	}
+
+	packetSource := gopacket.NewPacketSource(ring, layers.LinkTypeEthernet)
+	packetSource.DecodeOptions.Lazy = true
+	packetSource.NoCopy = true
+
+	return &pfringBackend{ring: ring, packetChan: packetSource.Packets()}, nil
+}
+
+func (b *pfringBackend) Packets() <-chan gopacket.Packet { return b.packetChan }
+
+func (b *pfringBackend) Stats() (CaptureStats, error) {
+	stats, err := b.ring.Stats()
+	if err != nil {
+		return CaptureStats{}, err
+	}
+	return CaptureStats{
+		PacketsReceived: uint64(stats.Received),
+		PacketsDropped:  uint64(stats.Dropped),
+	}, nil
+}
+
+func (b *pfringBackend) Close()                    { b.ring.Close() }
+func (b *pfringBackend) LinkType() layers.LinkType { return layers.LinkTypeEthernet }
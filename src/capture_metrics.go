@@ -0,0 +1,159 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	capturePacketsReceivedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dnsmonster_packets_received_total",
+		Help: "Packets received by the active capture engine, per the kernel's own counters.",
+	})
+	capturePacketsDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dnsmonster_packets_dropped_total",
+		Help: "Packets dropped by the kernel ring before dnsmonster could read them.",
+	})
+	capturePacketsIfDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dnsmonster_packets_ifdropped_total",
+		Help: "Packets dropped at the interface level before reaching the capture engine's ring.",
+	})
+	captureChannelDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dnsmonster_channel_depth",
+		Help: "Current number of queued items in an internal dnsmonster channel.",
+	}, []string{"channel"})
+)
+
+// lastCaptureStats mirrors the most recently sampled CaptureStats so the
+// /debug/vars expvar endpoint can report the same numbers as Prometheus
+// without polling the backend a second time.
+var (
+	lastCaptureStatsMu sync.Mutex
+	lastCaptureStats   CaptureStats
+)
+
+func init() {
+	expvar.Publish("dnsmonster_capture_stats", expvar.Func(func() interface{} {
+		lastCaptureStatsMu.Lock()
+		defer lastCaptureStatsMu.Unlock()
+		return lastCaptureStats
+	}))
+}
+
+// captureStatsSource lets the metrics goroutine started in NewDNSCapturer
+// poll whichever CaptureBackend Start() ends up constructing, without the
+// two having to agree on construction order: the backend only exists once
+// Start runs, while the exporter is wired up earlier.
+type captureStatsSource struct {
+	mu      sync.Mutex
+	backend CaptureBackend
+}
+
+func (s *captureStatsSource) set(backend CaptureBackend) {
+	s.mu.Lock()
+	s.backend = backend
+	s.mu.Unlock()
+}
+
+func (s *captureStatsSource) stats() (CaptureStats, bool) {
+	s.mu.Lock()
+	backend := s.backend
+	s.mu.Unlock()
+	if backend == nil {
+		return CaptureStats{}, false
+	}
+	stats, err := backend.Stats()
+	if err != nil {
+		log.Printf("Error reading capture backend stats: %s", err)
+		return CaptureStats{}, false
+	}
+	return stats, true
+}
+
+// captureMetricsChannels bundles the channels whose queue depth the exporter
+// samples on every tick.
+type captureMetricsChannels struct {
+	processing       chan gopacket.Packet
+	tcpChannels      []chan tcpPacket
+	ip4Defragger     chan ipv4ToDefrag
+	ip6Defragger     chan ipv6FragmentInfo
+	ip4DefraggerBack chan ipv4Defragged
+	ip6DefraggerBack chan ipv6Defragged
+}
+
+// startMetricsServer exposes Prometheus metrics at /metrics and the Go
+// runtime's expvar counters at /debug/vars on listenAddr. It runs until the
+// process exits; a failure to bind is logged but not fatal, since metrics
+// are a diagnostic nicety and shouldn't take capture down with them.
+func startMetricsServer(listenAddr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	log.Printf("Serving capture metrics on %s (/metrics, /debug/vars)\n", listenAddr)
+	if err := http.ListenAndServe(listenAddr, mux); err != nil {
+		log.Printf("Error serving capture metrics on %s: %s", listenAddr, err)
+	}
+}
+
+// sampleCaptureMetrics periodically publishes kernel capture counters and
+// internal channel depths so operators can tell kernel drops apart from
+// userspace backpressure.
+func sampleCaptureMetrics(options CaptureOptions, source *captureStatsSource, channels captureMetricsChannels) {
+	interval := options.MetricsSampleInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	var lastReceived, lastDropped, lastIfDropped uint64
+	addDelta := func(counter prometheus.Counter, last *uint64, current uint64) {
+		delta := current - *last
+		if current < *last {
+			// The backend was replaced (e.g. HUP-triggered re-open) and its
+			// counters reset; treat the new value as the delta rather than
+			// underflowing.
+			delta = current
+		}
+		counter.Add(float64(delta))
+		*last = current
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		select {
+		case <-options.Done:
+			return
+		default:
+		}
+
+		if stats, ok := source.stats(); ok {
+			addDelta(capturePacketsReceivedTotal, &lastReceived, stats.PacketsReceived)
+			addDelta(capturePacketsDroppedTotal, &lastDropped, stats.PacketsDropped)
+			addDelta(capturePacketsIfDroppedTotal, &lastIfDropped, stats.PacketsIfDropped)
+
+			lastCaptureStatsMu.Lock()
+			lastCaptureStats = stats
+			lastCaptureStatsMu.Unlock()
+		}
+
+		captureChannelDepth.WithLabelValues("processing").Set(float64(len(channels.processing)))
+		captureChannelDepth.WithLabelValues("ip4Defragger").Set(float64(len(channels.ip4Defragger)))
+		captureChannelDepth.WithLabelValues("ip6Defragger").Set(float64(len(channels.ip6Defragger)))
+		captureChannelDepth.WithLabelValues("ip4DefraggerReturn").Set(float64(len(channels.ip4DefraggerBack)))
+		captureChannelDepth.WithLabelValues("ip6DefraggerReturn").Set(float64(len(channels.ip6DefraggerBack)))
+
+		var tcpDepth int
+		for _, ch := range channels.tcpChannels {
+			tcpDepth += len(ch)
+		}
+		captureChannelDepth.WithLabelValues("tcpChannels").Set(float64(tcpDepth))
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapRotatingWriter owns the on-disk PCAP-NG file backing a
+// CaptureOptions.PcapWriterPath sink and rotates it once it grows past
+// RotateBytes or has been open longer than RotateInterval.
+type pcapRotatingWriter struct {
+	path           string
+	rotateBytes    uint64
+	rotateInterval time.Duration
+	linkType       layers.LinkType
+
+	file     *os.File
+	writer   *pcapgo.NgWriter
+	written  uint64
+	openedAt time.Time
+}
+
+func newPcapRotatingWriter(path string, rotateBytes uint64, rotateInterval time.Duration, linkType layers.LinkType) (*pcapRotatingWriter, error) {
+	w := &pcapRotatingWriter{
+		path:           path,
+		rotateBytes:    rotateBytes,
+		rotateInterval: rotateInterval,
+		linkType:       linkType,
+	}
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// rotate closes the current file (if any), renames it aside with a timestamp
+// suffix, and opens a fresh file at path so writers never block on a missing
+// destination.
+func (w *pcapRotatingWriter) rotate() error {
+	if w.writer != nil {
+		w.writer.Flush()
+	}
+	if w.file != nil {
+		w.file.Close()
+		rotated := fmt.Sprintf("%s.%s", w.path, time.Now().Format("20060102T150405.000000000"))
+		if err := os.Rename(w.path, rotated); err != nil {
+			log.Printf("Failed to rename rotated pcap file %s: %s", w.path, err)
+		}
+	}
+
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	ngWriter, err := pcapgo.NewNgWriter(f, w.linkType)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.writer = ngWriter
+	w.written = 0
+	w.openedAt = time.Now()
+	return nil
+}
+
+func (w *pcapRotatingWriter) needsRotation() bool {
+	if w.rotateBytes > 0 && w.written >= w.rotateBytes {
+		return true
+	}
+	if w.rotateInterval > 0 && time.Since(w.openedAt) >= w.rotateInterval {
+		return true
+	}
+	return false
+}
+
+func (w *pcapRotatingWriter) writePacket(ci gopacket.CaptureInfo, data []byte) {
+	if w.needsRotation() {
+		if err := w.rotate(); err != nil {
+			log.Printf("Failed to rotate pcap writer file %s: %s", w.path, err)
+			return
+		}
+	}
+	if err := w.writer.WritePacket(ci, data); err != nil {
+		log.Printf("Failed to write packet to pcap file %s: %s", w.path, err)
+		return
+	}
+	w.written += uint64(len(data))
+}
+
+func (w *pcapRotatingWriter) Close() {
+	if w.writer != nil {
+		w.writer.Flush()
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+}
+
+// pcapWriterTee sits between the live packet source and the encoder pool. It
+// forwards every packet to out untouched and, best-effort, archives a copy
+// through writer so operators keep a tcpdump-compatible record of exactly
+// what dnsmonster processed. writer is opened by the caller, synchronously,
+// so a bad PcapWriterPath surfaces as an error from Start instead of this
+// goroutine being the only thing that notices.
+func pcapWriterTee(in <-chan gopacket.Packet, out chan<- gopacket.Packet, writer *pcapRotatingWriter) {
+	defer writer.Close()
+	// Closing out once in drains dry lets shutdown()'s close(capturer.processing)
+	// propagate all the way to the encoder pool's channel, not just stop here.
+	defer close(out)
+
+	for packet := range in {
+		writer.writePacket(packet.Metadata().CaptureInfo, packet.Data())
+		out <- packet
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// zeroCopyDecoder wraps a gopacket.DecodingLayerParser pre-populated with the
+// handful of layers dnsmonster cares about, plus the scratch layer values it
+// reuses across packets. This is what lets the AF_PACKET reader avoid
+// building a full gopacket.Packet for the common case: a plain UDP DNS
+// datagram.
+type zeroCopyDecoder struct {
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+
+	eth     layers.Ethernet
+	dot1q   layers.Dot1Q
+	ip4     layers.IPv4
+	ip6     layers.IPv6
+	ip6frag layers.IPv6Fragment
+	udp     layers.UDP
+	tcp     layers.TCP
+	dns     layers.DNS
+}
+
+// newZeroCopyDecoder builds a decoder starting from layers.LayerTypeEthernet,
+// the only link type afpacketHandle ever reports.
+func newZeroCopyDecoder() *zeroCopyDecoder {
+	d := &zeroCopyDecoder{decoded: make([]gopacket.LayerType, 0, 8)}
+	d.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet,
+		&d.eth, &d.dot1q, &d.ip4, &d.ip6, &d.ip6frag, &d.udp, &d.tcp, &d.dns)
+	// A DNS response riding on an unexpected next layer shouldn't sink the
+	// whole frame; just stop decoding and let decodeAndRoute fall through.
+	d.parser.IgnoreUnsupported = true
+	return d
+}
+
+// decodeAndRoute decodes one captured frame and, if it turns out to be a
+// plain UDP DNS datagram on options.Port, pushes a DNSResult straight to
+// options.ResultChannel and reports true. Anything else - VLAN tagging this
+// parser doesn't expect, IPv6 fragments, TCP, or simply not DNS - reports
+// false so the caller can fall back to the regular gopacket.Packet path that
+// feeds the defragger and TCP assembler.
+func (d *zeroCopyDecoder) decodeAndRoute(data []byte, ci gopacket.CaptureInfo, options CaptureOptions) bool {
+	if err := d.parser.DecodeLayers(data, &d.decoded); err != nil {
+		return false
+	}
+
+	var sawIPv4, sawIPv6, sawUDP, sawDNS, needsFallback bool
+	for _, layerType := range d.decoded {
+		switch layerType {
+		case layers.LayerTypeIPv4:
+			sawIPv4 = true
+		case layers.LayerTypeIPv6:
+			sawIPv6 = true
+		case layers.LayerTypeUDP:
+			sawUDP = true
+		case layers.LayerTypeDNS:
+			sawDNS = true
+		case layers.LayerTypeTCP, layers.LayerTypeIPv6Fragment:
+			needsFallback = true
+		}
+	}
+	if needsFallback || !sawUDP || !sawDNS || (!sawIPv4 && !sawIPv6) {
+		return false
+	}
+	if uint16(d.udp.SrcPort) != options.Port && uint16(d.udp.DstPort) != options.Port {
+		return false
+	}
+
+	// result is sent by value over a channel an async output stage may hold
+	// onto well past this call returning, so - unlike the scratch layers
+	// above - nothing here can be pooled and reused; every field has to be
+	// its own fresh copy.
+	var result DNSResult
+	result.Timestamp = ci.Timestamp
+	result.Protocol = "udp"
+	result.PacketLength = uint16(ci.CaptureLength)
+	if sawIPv4 {
+		result.IPVersion = 4
+		result.SrcIP = append(net.IP(nil), d.ip4.SrcIP...)
+		result.DstIP = append(net.IP(nil), d.ip4.DstIP...)
+	} else {
+		result.IPVersion = 6
+		result.SrcIP = append(net.IP(nil), d.ip6.SrcIP...)
+		result.DstIP = append(net.IP(nil), d.ip6.DstIP...)
+	}
+
+	if err := result.DNS.Unpack(d.udp.Payload); err != nil {
+		return false
+	}
+
+	select {
+	case options.ResultChannel <- result:
+	case <-options.Done:
+	}
+	return true
+}
+
+// runAfpacketReader drains one AF_PACKET socket, routing plain UDP DNS
+// datagrams straight to options.ResultChannel through zeroCopyDecoder and
+// falling back to a regular gopacket.Packet on out for everything else
+// (fragments, TCP segments, anything the fast-path parser didn't expect).
+// The kernel ring recycles handle's buffer as soon as ZeroCopyReadPacketData
+// is called again, so the frame is copied out before either path keeps it.
+//
+// stop is this reader's own backend instance being closed (e.g. a SIGHUP
+// reload replacing it), distinct from options.Done which only fires on final
+// process shutdown; without it a reader outliving its backend would spin
+// forever on the now-closed socket's read errors.
+func runAfpacketReader(handle *afpacketHandle, out chan<- gopacket.Packet, stop <-chan struct{}, options CaptureOptions) {
+	decoder := newZeroCopyDecoder()
+	var loggedReadErr bool
+	for {
+		data, ci, err := handle.ZeroCopyReadPacketData()
+		if err != nil {
+			select {
+			case <-stop:
+				return
+			case <-options.Done:
+				return
+			default:
+			}
+			// A persistent read error (e.g. the link going down) would
+			// otherwise busy-spin this goroutine at 100% CPU; log it once
+			// and back off instead of retrying immediately.
+			if !loggedReadErr {
+				log.Printf("Error reading from afpacket handle, backing off: %s", err)
+				loggedReadErr = true
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		loggedReadErr = false
+
+		frame := append([]byte(nil), data...)
+		if decoder.decodeAndRoute(frame, ci, options) {
+			continue
+		}
+
+		packet := gopacket.NewPacket(frame, handle.LinkType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		packet.Metadata().CaptureInfo = ci
+		select {
+		case out <- packet:
+		case <-stop:
+			return
+		case <-options.Done:
+			return
+		}
+	}
+}